@@ -0,0 +1,136 @@
+package plugin
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"sync"
+
+	"github.com/pkg/errors"
+	v1 "github.com/vmware-tanzu/velero/pkg/apis/velero/v1"
+	corev1 "k8s.io/api/core/v1"
+	apierrors "k8s.io/apimachinery/pkg/api/errors"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+)
+
+// ImageChange is one container image rewrite performed during a restore.
+type ImageChange struct {
+	Namespace string `json:"namespace"`
+	Kind      string `json:"kind"`
+	Name      string `json:"name"`
+	Container string `json:"container"`
+	OldImage  string `json:"oldImage"`
+	NewImage  string `json:"newImage"`
+	// Trigger identifies what caused the rewrite: "annotation" for the
+	// per-object annotation, or the name/index of the rules ConfigMap rule.
+	Trigger string `json:"trigger"`
+}
+
+// restoreReport accumulates the ImageChanges made so far for a single
+// restore, grouped by the object they belong to.
+type restoreReport struct {
+	mu      sync.Mutex
+	objects map[string][]ImageChange // keyed by namespace/kind/name
+}
+
+func (r *restoreReport) add(change ImageChange) {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	key := fmt.Sprintf("%s/%s/%s", change.Namespace, change.Kind, change.Name)
+	r.objects[key] = append(r.objects[key], change)
+}
+
+// recordChange appends change to the in-memory report for restore. It is a
+// no-op if restore is nil (e.g. in tests that call Execute directly), since
+// there is then no restore to key the report off of.
+func (p *RestorePluginV2) recordChange(restore *v1.Restore, change ImageChange) {
+	if restore == nil {
+		return
+	}
+
+	val, _ := p.reports.LoadOrStore(restore.UID, &restoreReport{objects: map[string][]ImageChange{}})
+	val.(*restoreReport).add(change)
+}
+
+// flushReport writes the accumulated image-change report for restore to a
+// ConfigMap named "image-rewrite-result-<restore-name>" in the restore's
+// namespace (the Velero install namespace), one data key per rewritten
+// object. It is idempotent per restore UID: subsequent calls for the same
+// restore are no-ops.
+func (p *RestorePluginV2) flushReport(restore *v1.Restore) error {
+	if restore == nil {
+		return nil
+	}
+
+	onceVal, _ := p.flushOnces.LoadOrStore(restore.UID, &sync.Once{})
+	once := onceVal.(*sync.Once)
+
+	var flushErr error
+	once.Do(func() {
+		flushErr = p.writeResultConfigMap(restore)
+	})
+	return flushErr
+}
+
+func (p *RestorePluginV2) writeResultConfigMap(restore *v1.Restore) error {
+	val, ok := p.reports.Load(restore.UID)
+	if !ok {
+		return nil
+	}
+	report := val.(*restoreReport)
+
+	report.mu.Lock()
+	defer report.mu.Unlock()
+
+	if len(report.objects) == 0 {
+		return nil
+	}
+
+	data := make(map[string]string, len(report.objects))
+	for key, changes := range report.objects {
+		encoded, err := json.Marshal(changes)
+		if err != nil {
+			return errors.Wrapf(err, "failed to marshal image rewrite result for %s", key)
+		}
+		data[sanitizeConfigMapKey(key)] = string(encoded)
+	}
+
+	client, err := p.getKubeClient()
+	if err != nil {
+		return err
+	}
+
+	configMaps := client.CoreV1().ConfigMaps(restore.Namespace)
+	result := &corev1.ConfigMap{
+		ObjectMeta: metav1.ObjectMeta{
+			Name:      "image-rewrite-result-" + restore.Name,
+			Namespace: restore.Namespace,
+		},
+		Data: data,
+	}
+
+	if _, err := configMaps.Create(context.Background(), result, metav1.CreateOptions{}); err != nil {
+		if !apierrors.IsAlreadyExists(err) {
+			return errors.Wrapf(err, "failed to create image rewrite result configmap for restore %s", restore.Name)
+		}
+		if _, err := configMaps.Update(context.Background(), result, metav1.UpdateOptions{}); err != nil {
+			return errors.Wrapf(err, "failed to update image rewrite result configmap for restore %s", restore.Name)
+		}
+	}
+
+	return nil
+}
+
+// sanitizeConfigMapKey turns a namespace/kind/name key into something that's
+// valid as a ConfigMap data key (which must match [-._a-zA-Z0-9]+).
+func sanitizeConfigMapKey(key string) string {
+	out := make([]byte, len(key))
+	for i := 0; i < len(key); i++ {
+		if key[i] == '/' {
+			out[i] = '_'
+		} else {
+			out[i] = key[i]
+		}
+	}
+	return string(out)
+}
@@ -0,0 +1,88 @@
+package plugin
+
+import "strings"
+
+// ImageReference is the decomposed form of a container image reference, following
+// the same domain/path/tag/digest grammar as github.com/distribution/reference:
+//
+//	[domain/]path[:tag][@digest]
+//
+// domain is only ever set when the first path component looks like a domain
+// (contains a "." or ":", or is exactly "localhost"); otherwise it is treated
+// as part of path, same as the Docker CLI does for images like "library/nginx".
+type ImageReference struct {
+	Domain string
+	Path   string
+	Tag    string
+	Digest string
+}
+
+// ParseImageReference splits image into its domain, path, tag and digest
+// components. It is deliberately lenient: callers that only need the tag (the
+// previous behaviour of this package) still get a usable result for malformed
+// input, since any component it can't confidently identify is left empty.
+func ParseImageReference(image string) ImageReference {
+	var ref ImageReference
+
+	working := image
+	if at := strings.LastIndex(working, "@"); at != -1 {
+		ref.Digest = working[at+1:]
+		working = working[:at]
+	}
+
+	remainder := working
+	if slash := strings.Index(working, "/"); slash != -1 {
+		firstComponent := working[:slash]
+		if strings.ContainsAny(firstComponent, ".:") || firstComponent == "localhost" {
+			ref.Domain = firstComponent
+			remainder = working[slash+1:]
+		}
+	}
+
+	// The tag, if any, is the last colon-separated segment of the final path
+	// component -- this is what keeps a registry port (host:5000/path) from
+	// being mistaken for a tag.
+	pathPart := remainder
+	lastSlash := strings.LastIndex(remainder, "/")
+	tail := remainder[lastSlash+1:]
+	if colon := strings.LastIndex(tail, ":"); colon != -1 {
+		ref.Tag = tail[colon+1:]
+		pathPart = remainder[:lastSlash+1] + tail[:colon]
+	}
+	ref.Path = pathPart
+
+	return ref
+}
+
+// String rebuilds the image reference. If both Tag and Digest are set, the
+// digest takes precedence, matching how the registry actually resolves a
+// pinned reference.
+func (r ImageReference) String() string {
+	var b strings.Builder
+	if r.Domain != "" {
+		b.WriteString(r.Domain)
+		b.WriteString("/")
+	}
+	b.WriteString(r.Path)
+	switch {
+	case r.Digest != "":
+		b.WriteString("@")
+		b.WriteString(r.Digest)
+	case r.Tag != "":
+		b.WriteString(":")
+		b.WriteString(r.Tag)
+	}
+	return b.String()
+}
+
+// resolveImage rebuilds newImage against currentImage, keeping currentImage's
+// tag or digest when newImage doesn't explicitly supply one.
+func resolveImage(currentImage, newImage string) string {
+	current := ParseImageReference(currentImage)
+	next := ParseImageReference(newImage)
+	if next.Tag == "" && next.Digest == "" {
+		next.Tag = current.Tag
+		next.Digest = current.Digest
+	}
+	return next.String()
+}
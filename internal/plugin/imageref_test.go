@@ -0,0 +1,94 @@
+package plugin
+
+import "testing"
+
+func TestParseImageReference(t *testing.T) {
+	tests := []struct {
+		name  string
+		image string
+		want  ImageReference
+	}{
+		{
+			name:  "repo and tag",
+			image: "app:v1.2.3",
+			want:  ImageReference{Path: "app", Tag: "v1.2.3"},
+		},
+		{
+			name:  "registry with port and tag",
+			image: "registry.example.com:5000/app:v1",
+			want:  ImageReference{Domain: "registry.example.com:5000", Path: "app", Tag: "v1"},
+		},
+		{
+			name:  "digest pinned image",
+			image: "app@sha256:abcdef0123456789",
+			want:  ImageReference{Path: "app", Digest: "sha256:abcdef0123456789"},
+		},
+		{
+			name:  "registry with port and digest",
+			image: "registry.example.com:5000/ns/app@sha256:abcdef0123456789",
+			want:  ImageReference{Domain: "registry.example.com:5000", Path: "ns/app", Digest: "sha256:abcdef0123456789"},
+		},
+		{
+			name:  "no tag or digest",
+			image: "docker.io/library/nginx",
+			want:  ImageReference{Domain: "docker.io", Path: "library/nginx"},
+		},
+		{
+			name:  "localhost registry without port",
+			image: "localhost/app:v1",
+			want:  ImageReference{Domain: "localhost", Path: "app", Tag: "v1"},
+		},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			got := ParseImageReference(tt.image)
+			if got != tt.want {
+				t.Errorf("ParseImageReference(%q) = %+v, want %+v", tt.image, got, tt.want)
+			}
+		})
+	}
+}
+
+func TestResolveImage(t *testing.T) {
+	tests := []struct {
+		name         string
+		currentImage string
+		newImage     string
+		want         string
+	}{
+		{
+			name:         "keeps current tag when new image has none",
+			currentImage: "old-registry/app:v1.2.3",
+			newImage:     "new-registry/app",
+			want:         "new-registry/app:v1.2.3",
+		},
+		{
+			name:         "new image tag takes precedence",
+			currentImage: "old-registry/app:v1.0.0",
+			newImage:     "new-registry/app:v2.0.0",
+			want:         "new-registry/app:v2.0.0",
+		},
+		{
+			name:         "new image digest takes precedence over current tag",
+			currentImage: "old-registry/app:v1.0.0",
+			newImage:     "new-registry/app@sha256:abcdef0123456789",
+			want:         "new-registry/app@sha256:abcdef0123456789",
+		},
+		{
+			name:         "preserves registry port on the new image",
+			currentImage: "old-registry:5000/app:v1.0.0",
+			newImage:     "new-registry:5000/app",
+			want:         "new-registry:5000/app:v1.0.0",
+		},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			got := resolveImage(tt.currentImage, tt.newImage)
+			if got != tt.want {
+				t.Errorf("resolveImage(%q, %q) = %q, want %q", tt.currentImage, tt.newImage, got, tt.want)
+			}
+		})
+	}
+}
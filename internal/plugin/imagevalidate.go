@@ -0,0 +1,391 @@
+package plugin
+
+import (
+	"context"
+	"encoding/base64"
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"strings"
+	"sync"
+
+	"github.com/pkg/errors"
+	v1 "github.com/vmware-tanzu/velero/pkg/apis/velero/v1"
+	corev1 "k8s.io/api/core/v1"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	"k8s.io/apimachinery/pkg/apis/meta/v1/unstructured"
+	"k8s.io/apimachinery/pkg/types"
+)
+
+// manifestAccept is the Accept header sent when probing a registry's v2
+// manifests endpoint, matching what Docker and OCI clients negotiate.
+const manifestAccept = "application/vnd.oci.image.manifest.v1+json, application/vnd.docker.distribution.manifest.v2+json"
+
+// registryHTTPClient is the client defaultManifestChecker uses to reach
+// registries and token endpoints; tests swap it for one pointed at an
+// httptest server.
+var registryHTTPClient = http.DefaultClient
+
+// ManifestChecker checks whether an image reference's manifest exists in its
+// registry. The default implementation talks to the registry's v2 HTTP API;
+// tests inject a fake via RestorePluginV2.manifestChecker.
+type ManifestChecker interface {
+	Exists(ctx context.Context, ref ImageReference, auth *registryAuth) (bool, error)
+}
+
+// registryAuth holds basic-auth credentials for a single registry, sourced
+// from a pod's imagePullSecrets.
+type registryAuth struct {
+	Username string
+	Password string
+}
+
+// imageValidator decides whether a container's rewritten image may be
+// applied. It returns apply=false, err=nil when validation failed but the
+// configured policy is "warn" (keep the original image), and a non-nil err
+// when the policy is "fail", which aborts the restore item.
+type imageValidator func(containerName, oldImage, newImage string) (apply bool, err error)
+
+// validateResult is the cached outcome of checking whether an image exists.
+type validateResult struct {
+	exists bool
+	err    error
+}
+
+// validationPolicy resolves whether image validation is enabled for item and
+// which policy applies ("fail" or "warn"), preferring the per-object
+// annotations over the cluster-wide default carried by the rules ConfigMap.
+// Policy defaults to "fail" when validation is enabled but no policy is set.
+func validationPolicy(item *unstructured.Unstructured, rs *RuleSet) (enabled bool, policy string) {
+	annotations := item.GetAnnotations()
+
+	if raw, ok := annotations[validateImageAnnotation]; ok {
+		enabled = raw == "true"
+	} else if rs != nil {
+		enabled = rs.ValidateImage
+	}
+
+	policy = "fail"
+	if raw, ok := annotations[validateImagePolicyAnnotation]; ok && raw != "" {
+		policy = raw
+	} else if rs != nil && rs.ValidateImagePolicy != "" {
+		policy = rs.ValidateImagePolicy
+	}
+	return enabled, policy
+}
+
+// buildImageValidator returns nil (validation disabled) unless enabled is
+// true, in which case it returns a validator that checks each rewritten image
+// against its registry, caching results for the lifetime of restore.
+func (p *RestorePluginV2) buildImageValidator(restore *v1.Restore, namespace string, pullSecrets []corev1.LocalObjectReference, enabled bool, policy string) imageValidator {
+	if !enabled {
+		return nil
+	}
+	return func(containerName, oldImage, newImage string) (bool, error) {
+		exists, err := p.checkImageExists(restore, namespace, pullSecrets, newImage)
+		if err != nil {
+			if policy == "warn" {
+				p.log.Warnf("failed to validate image %q for container %q: %v; keeping original image %q", newImage, containerName, err, oldImage)
+				return false, nil
+			}
+			return false, errors.Wrapf(err, "failed to validate image %q for container %q", newImage, containerName)
+		}
+		if exists {
+			return true, nil
+		}
+		if policy == "warn" {
+			p.log.Warnf("image %q for container %q not found in registry; keeping original image %q", newImage, containerName, oldImage)
+			return false, nil
+		}
+		return false, errors.Errorf("image %q for container %q not found in registry", newImage, containerName)
+	}
+}
+
+// checkImageExists resolves whether image's manifest exists in its registry,
+// consulting and populating the per-restore cache first.
+func (p *RestorePluginV2) checkImageExists(restore *v1.Restore, namespace string, pullSecrets []corev1.LocalObjectReference, image string) (bool, error) {
+	ref := ParseImageReference(image)
+	cacheKey := ref.String()
+
+	if restore != nil {
+		if cached, ok := p.loadValidateResult(restore.UID, cacheKey); ok {
+			return cached.exists, cached.err
+		}
+	}
+
+	auth, err := p.loadRegistryAuth(namespace, pullSecrets, registryHost(ref.Domain))
+	if err != nil {
+		p.log.Warnf("failed to load registry credentials for %s: %v", ref.Domain, err)
+		auth = nil
+	}
+
+	checker := p.manifestChecker
+	if checker == nil {
+		checker = defaultManifestChecker{}
+	}
+	exists, err := checker.Exists(context.Background(), ref, auth)
+
+	if restore != nil {
+		p.storeValidateResult(restore.UID, cacheKey, validateResult{exists: exists, err: err})
+	}
+	return exists, err
+}
+
+func (p *RestorePluginV2) loadValidateResult(uid types.UID, key string) (validateResult, bool) {
+	val, ok := p.validateCache.Load(uid)
+	if !ok {
+		return validateResult{}, false
+	}
+	cached, ok := val.(*sync.Map).Load(key)
+	if !ok {
+		return validateResult{}, false
+	}
+	return cached.(validateResult), true
+}
+
+func (p *RestorePluginV2) storeValidateResult(uid types.UID, key string, result validateResult) {
+	val, _ := p.validateCache.LoadOrStore(uid, &sync.Map{})
+	val.(*sync.Map).Store(key, result)
+}
+
+// loadRegistryAuth looks through pullSecrets (a pod's imagePullSecrets) for a
+// dockerconfigjson Secret with credentials for host, returning nil, nil if
+// none of them have one -- registry validation then proceeds anonymously.
+func (p *RestorePluginV2) loadRegistryAuth(namespace string, pullSecrets []corev1.LocalObjectReference, host string) (*registryAuth, error) {
+	if len(pullSecrets) == 0 {
+		return nil, nil
+	}
+
+	client, err := p.getKubeClient()
+	if err != nil {
+		return nil, err
+	}
+
+	for _, secretRef := range pullSecrets {
+		secret, err := client.CoreV1().Secrets(namespace).Get(context.Background(), secretRef.Name, metav1.GetOptions{})
+		if err != nil {
+			return nil, errors.Wrapf(err, "failed to get imagePullSecret %s/%s", namespace, secretRef.Name)
+		}
+		if auth, ok := parseDockerConfigAuth(secret, host); ok {
+			return auth, nil
+		}
+	}
+	return nil, nil
+}
+
+// parseDockerConfigAuth extracts credentials for host from a
+// kubernetes.io/dockerconfigjson Secret's .dockerconfigjson data key.
+func parseDockerConfigAuth(secret *corev1.Secret, host string) (*registryAuth, bool) {
+	raw, ok := secret.Data[corev1.DockerConfigJsonKey]
+	if !ok {
+		return nil, false
+	}
+
+	var config struct {
+		Auths map[string]struct {
+			Auth     string `json:"auth"`
+			Username string `json:"username"`
+			Password string `json:"password"`
+		} `json:"auths"`
+	}
+	if err := json.Unmarshal(raw, &config); err != nil {
+		return nil, false
+	}
+
+	entry, ok := config.Auths[host]
+	if !ok {
+		return nil, false
+	}
+	if entry.Username != "" || entry.Password != "" {
+		return &registryAuth{Username: entry.Username, Password: entry.Password}, true
+	}
+	if entry.Auth == "" {
+		return nil, false
+	}
+	decoded, err := base64.StdEncoding.DecodeString(entry.Auth)
+	if err != nil {
+		return nil, false
+	}
+	user, pass, ok := strings.Cut(string(decoded), ":")
+	if !ok {
+		return nil, false
+	}
+	return &registryAuth{Username: user, Password: pass}, true
+}
+
+// registryHost returns the effective registry host for domain, defaulting an
+// unqualified reference (e.g. "nginx:1.25") to Docker Hub's API host.
+func registryHost(domain string) string {
+	if domain == "" {
+		return "registry-1.docker.io"
+	}
+	return domain
+}
+
+// repositoryPath returns ref's repository path as the registry expects it,
+// prefixing unqualified Docker Hub images with "library/" (e.g. "nginx"
+// becomes "library/nginx", matching how Docker Hub stores official images).
+func repositoryPath(ref ImageReference) string {
+	if ref.Domain != "" || strings.Contains(ref.Path, "/") {
+		return ref.Path
+	}
+	return "library/" + ref.Path
+}
+
+// defaultManifestChecker is the production ManifestChecker: it issues a GET
+// against the registry's v2 manifests endpoint, transparently completing the
+// Docker Registry v2 / OCI distribution-spec bearer-token challenge that most
+// registries (Docker Hub, ECR, GCR, GHCR, Quay) issue even for anonymous
+// pulls of public images. A 200 response is treated as "exists", a 404 as
+// "does not exist", and a 401/403 that survives the bearer-token retry as an
+// error, since it means the check itself couldn't be completed.
+type defaultManifestChecker struct{}
+
+func (defaultManifestChecker) Exists(ctx context.Context, ref ImageReference, auth *registryAuth) (bool, error) {
+	tagOrDigest := ref.Digest
+	if tagOrDigest == "" {
+		tagOrDigest = ref.Tag
+	}
+	if tagOrDigest == "" {
+		tagOrDigest = "latest"
+	}
+
+	url := fmt.Sprintf("https://%s/v2/%s/manifests/%s", registryHost(ref.Domain), repositoryPath(ref), tagOrDigest)
+
+	resp, err := getManifest(ctx, url, auth, "")
+	if err != nil {
+		return false, err
+	}
+	defer resp.Body.Close()
+
+	if resp.StatusCode == http.StatusUnauthorized {
+		if challenge, ok := parseWWWAuthenticateBearer(resp.Header.Get("WWW-Authenticate")); ok {
+			resp.Body.Close()
+			token, err := bearerToken(ctx, challenge, auth)
+			if err != nil {
+				return false, errors.Wrapf(err, "failed to obtain bearer token for %s", ref.String())
+			}
+			resp, err = getManifest(ctx, url, nil, token)
+			if err != nil {
+				return false, err
+			}
+			defer resp.Body.Close()
+		}
+	}
+
+	switch resp.StatusCode {
+	case http.StatusOK:
+		return true, nil
+	case http.StatusNotFound:
+		return false, nil
+	case http.StatusUnauthorized, http.StatusForbidden:
+		return false, errors.Errorf("not authorized to check manifest for %s", ref.String())
+	default:
+		return false, errors.Errorf("unexpected status %d checking manifest for %s", resp.StatusCode, ref.String())
+	}
+}
+
+// getManifest issues the manifest GET for url, authenticating with bearer (if
+// set) or auth's basic-auth credentials (if non-nil); anonymous otherwise.
+func getManifest(ctx context.Context, url string, auth *registryAuth, bearer string) (*http.Response, error) {
+	req, err := http.NewRequestWithContext(ctx, http.MethodGet, url, nil)
+	if err != nil {
+		return nil, errors.WithStack(err)
+	}
+	req.Header.Set("Accept", manifestAccept)
+	switch {
+	case bearer != "":
+		req.Header.Set("Authorization", "Bearer "+bearer)
+	case auth != nil:
+		req.SetBasicAuth(auth.Username, auth.Password)
+	}
+
+	resp, err := registryHTTPClient.Do(req)
+	if err != nil {
+		return nil, errors.Wrapf(err, "failed to reach registry for %s", url)
+	}
+	return resp, nil
+}
+
+// wwwAuthenticateBearer holds the parameters of a Bearer challenge as sent in
+// a registry's WWW-Authenticate response header, e.g. Bearer
+// realm="https://auth.docker.io/token",service="registry.docker.io",scope="repository:library/nginx:pull".
+type wwwAuthenticateBearer struct {
+	realm   string
+	service string
+	scope   string
+}
+
+// parseWWWAuthenticateBearer parses header, returning ok=false if it isn't a
+// Bearer challenge (e.g. it's absent, or it's a Basic challenge instead).
+func parseWWWAuthenticateBearer(header string) (wwwAuthenticateBearer, bool) {
+	const prefix = "Bearer "
+	if !strings.HasPrefix(header, prefix) {
+		return wwwAuthenticateBearer{}, false
+	}
+
+	var challenge wwwAuthenticateBearer
+	for _, part := range strings.Split(header[len(prefix):], ",") {
+		key, value, ok := strings.Cut(strings.TrimSpace(part), "=")
+		if !ok {
+			continue
+		}
+		value = strings.Trim(value, `"`)
+		switch key {
+		case "realm":
+			challenge.realm = value
+		case "service":
+			challenge.service = value
+		case "scope":
+			challenge.scope = value
+		}
+	}
+	if challenge.realm == "" {
+		return wwwAuthenticateBearer{}, false
+	}
+	return challenge, true
+}
+
+// bearerToken exchanges challenge for a short-lived bearer token per the
+// Docker Registry v2 / OCI distribution-spec token-auth flow, presenting
+// auth's credentials if set and proceeding anonymously otherwise (as
+// required for public-image pulls against registries like Docker Hub).
+func bearerToken(ctx context.Context, challenge wwwAuthenticateBearer, auth *registryAuth) (string, error) {
+	req, err := http.NewRequestWithContext(ctx, http.MethodGet, challenge.realm, nil)
+	if err != nil {
+		return "", errors.WithStack(err)
+	}
+	query := req.URL.Query()
+	if challenge.service != "" {
+		query.Set("service", challenge.service)
+	}
+	if challenge.scope != "" {
+		query.Set("scope", challenge.scope)
+	}
+	req.URL.RawQuery = query.Encode()
+	if auth != nil {
+		req.SetBasicAuth(auth.Username, auth.Password)
+	}
+
+	resp, err := registryHTTPClient.Do(req)
+	if err != nil {
+		return "", errors.Wrapf(err, "failed to reach token endpoint %s", challenge.realm)
+	}
+	defer resp.Body.Close()
+
+	if resp.StatusCode != http.StatusOK {
+		return "", errors.Errorf("unexpected status %d from token endpoint %s", resp.StatusCode, challenge.realm)
+	}
+
+	var body struct {
+		Token       string `json:"token"`
+		AccessToken string `json:"access_token"`
+	}
+	if err := json.NewDecoder(resp.Body).Decode(&body); err != nil {
+		return "", errors.Wrapf(err, "failed to decode token response from %s", challenge.realm)
+	}
+	if body.Token != "" {
+		return body.Token, nil
+	}
+	return body.AccessToken, nil
+}
@@ -0,0 +1,348 @@
+package plugin
+
+import (
+	"context"
+	"fmt"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+
+	"github.com/sirupsen/logrus"
+	velerov1 "github.com/vmware-tanzu/velero/pkg/apis/velero/v1"
+	"github.com/vmware-tanzu/velero/pkg/plugin/velero"
+	appsv1 "k8s.io/api/apps/v1"
+	corev1 "k8s.io/api/core/v1"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	"k8s.io/apimachinery/pkg/apis/meta/v1/unstructured"
+	"k8s.io/apimachinery/pkg/runtime"
+	"k8s.io/apimachinery/pkg/types"
+	"k8s.io/client-go/kubernetes/fake"
+)
+
+// fakeManifestChecker reports ref.String() as existing iff exists maps it to
+// true, and counts how many times it's called.
+type fakeManifestChecker struct {
+	exists map[string]bool
+	calls  int
+}
+
+func (c *fakeManifestChecker) Exists(_ context.Context, ref ImageReference, _ *registryAuth) (bool, error) {
+	c.calls++
+	return c.exists[ref.String()], nil
+}
+
+func validateDeploymentInput(annotations map[string]string, image string) *velero.RestoreItemActionExecuteInput {
+	deployment := appsv1.Deployment{
+		ObjectMeta: metav1.ObjectMeta{
+			Name:        "test-deployment",
+			Namespace:   "test-namespace",
+			Annotations: annotations,
+		},
+		Spec: appsv1.DeploymentSpec{
+			Template: corev1.PodTemplateSpec{
+				Spec: corev1.PodSpec{
+					Containers: []corev1.Container{
+						{Name: "app", Image: image},
+					},
+				},
+			},
+		},
+	}
+
+	deploymentUnstructured, err := runtime.DefaultUnstructuredConverter.ToUnstructured(&deployment)
+	if err != nil {
+		panic(err)
+	}
+	deploymentUnstructured["kind"] = "Deployment"
+
+	return &velero.RestoreItemActionExecuteInput{
+		Item: &unstructured.Unstructured{Object: deploymentUnstructured},
+	}
+}
+
+func updatedDeploymentImage(t *testing.T, output *velero.RestoreItemActionExecuteOutput) string {
+	t.Helper()
+	var updated appsv1.Deployment
+	if err := runtime.DefaultUnstructuredConverter.FromUnstructured(output.UpdatedItem.UnstructuredContent(), &updated); err != nil {
+		t.Fatalf("Error converting output to Deployment: %v", err)
+	}
+	return updated.Spec.Template.Spec.Containers[0].Image
+}
+
+func TestRestorePluginV2_Execute_ImageValidation(t *testing.T) {
+	t.Run("fail policy aborts the restore item when the image is missing", func(t *testing.T) {
+		input := validateDeploymentInput(map[string]string{
+			containerImageAnnotation: "new-registry/app",
+			validateImageAnnotation:  "true",
+		}, "old-registry/app:v1.2.3")
+
+		plugin := &RestorePluginV2{
+			log:             logrus.New(),
+			manifestChecker: &fakeManifestChecker{exists: map[string]bool{}},
+		}
+
+		if _, err := plugin.Execute(input); err == nil {
+			t.Fatal("Execute() error = nil, want error for a missing image under the fail policy")
+		}
+	})
+
+	t.Run("warn policy keeps the original image when the new one is missing", func(t *testing.T) {
+		input := validateDeploymentInput(map[string]string{
+			containerImageAnnotation:      "new-registry/app",
+			validateImageAnnotation:       "true",
+			validateImagePolicyAnnotation: "warn",
+		}, "old-registry/app:v1.2.3")
+
+		plugin := &RestorePluginV2{
+			log:             logrus.New(),
+			manifestChecker: &fakeManifestChecker{exists: map[string]bool{}},
+		}
+
+		output, err := plugin.Execute(input)
+		if err != nil {
+			t.Fatalf("Execute() error = %v, want nil under the warn policy", err)
+		}
+
+		if got, want := updatedDeploymentImage(t, output), "old-registry/app:v1.2.3"; got != want {
+			t.Errorf("Execute() image = %v, want unchanged %v", got, want)
+		}
+	})
+
+	t.Run("rewrite proceeds once the image is confirmed to exist", func(t *testing.T) {
+		input := validateDeploymentInput(map[string]string{
+			containerImageAnnotation: "new-registry/app",
+			validateImageAnnotation:  "true",
+		}, "old-registry/app:v1.2.3")
+
+		plugin := &RestorePluginV2{
+			log:             logrus.New(),
+			manifestChecker: &fakeManifestChecker{exists: map[string]bool{"new-registry/app:v1.2.3": true}},
+		}
+
+		output, err := plugin.Execute(input)
+		if err != nil {
+			t.Fatalf("Execute() error = %v", err)
+		}
+
+		if got, want := updatedDeploymentImage(t, output), "new-registry/app:v1.2.3"; got != want {
+			t.Errorf("Execute() image = %v, want %v", got, want)
+		}
+	})
+
+	t.Run("checker result is cached per restore so a repeated image is only checked once", func(t *testing.T) {
+		input := validateDeploymentInput(map[string]string{
+			containerImageAnnotation: "new-registry/app",
+			validateImageAnnotation:  "true",
+		}, "old-registry/app:v1.2.3")
+		input.Restore = &velerov1.Restore{
+			ObjectMeta: metav1.ObjectMeta{
+				Name:      "test-restore",
+				Namespace: "velero",
+				UID:       types.UID("test-restore-uid"),
+			},
+		}
+
+		checker := &fakeManifestChecker{exists: map[string]bool{"new-registry/app:v1.2.3": true}}
+		plugin := &RestorePluginV2{
+			log:             logrus.New(),
+			manifestChecker: checker,
+			kubeClient:      fake.NewSimpleClientset(),
+		}
+
+		if _, err := plugin.Execute(input); err != nil {
+			t.Fatalf("Execute() error = %v", err)
+		}
+		if _, err := plugin.Execute(input); err != nil {
+			t.Fatalf("Execute() second call error = %v", err)
+		}
+
+		if checker.calls != 1 {
+			t.Errorf("manifest checker called %d times, want 1 (second lookup should hit the cache)", checker.calls)
+		}
+	})
+}
+
+func TestRegistryHost(t *testing.T) {
+	tests := []struct {
+		domain string
+		want   string
+	}{
+		{domain: "", want: "registry-1.docker.io"},
+		{domain: "my-registry.internal", want: "my-registry.internal"},
+		{domain: "my-registry.internal:5000", want: "my-registry.internal:5000"},
+	}
+	for _, tt := range tests {
+		if got := registryHost(tt.domain); got != tt.want {
+			t.Errorf("registryHost(%q) = %q, want %q", tt.domain, got, tt.want)
+		}
+	}
+}
+
+func TestRepositoryPath(t *testing.T) {
+	tests := []struct {
+		name string
+		ref  ImageReference
+		want string
+	}{
+		{name: "unqualified docker hub image", ref: ImageReference{Path: "nginx"}, want: "library/nginx"},
+		{name: "docker hub image with namespace", ref: ImageReference{Path: "library/nginx"}, want: "library/nginx"},
+		{name: "private registry image", ref: ImageReference{Domain: "my-registry.internal", Path: "app"}, want: "app"},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			if got := repositoryPath(tt.ref); got != tt.want {
+				t.Errorf("repositoryPath(%+v) = %q, want %q", tt.ref, got, tt.want)
+			}
+		})
+	}
+}
+
+func TestParseDockerConfigAuth(t *testing.T) {
+	secret := &corev1.Secret{
+		ObjectMeta: metav1.ObjectMeta{Name: "regcred"},
+		Data: map[string][]byte{
+			corev1.DockerConfigJsonKey: []byte(`{"auths":{"my-registry.internal":{"auth":"dXNlcjpwYXNz"}}}`),
+		},
+	}
+
+	auth, ok := parseDockerConfigAuth(secret, "my-registry.internal")
+	if !ok {
+		t.Fatal("parseDockerConfigAuth() ok = false, want true")
+	}
+	if auth.Username != "user" || auth.Password != "pass" {
+		t.Errorf("parseDockerConfigAuth() = %+v, want {user pass}", auth)
+	}
+
+	if _, ok := parseDockerConfigAuth(secret, "other-registry.internal"); ok {
+		t.Error("parseDockerConfigAuth() ok = true for a registry not in the secret, want false")
+	}
+}
+
+func TestParseWWWAuthenticateBearer(t *testing.T) {
+	tests := []struct {
+		name   string
+		header string
+		want   wwwAuthenticateBearer
+		wantOK bool
+	}{
+		{
+			name:   "docker hub style challenge",
+			header: `Bearer realm="https://auth.docker.io/token",service="registry.docker.io",scope="repository:library/nginx:pull"`,
+			want:   wwwAuthenticateBearer{realm: "https://auth.docker.io/token", service: "registry.docker.io", scope: "repository:library/nginx:pull"},
+			wantOK: true,
+		},
+		{
+			name:   "realm only",
+			header: `Bearer realm="https://ghcr.io/token"`,
+			want:   wwwAuthenticateBearer{realm: "https://ghcr.io/token"},
+			wantOK: true,
+		},
+		{
+			name:   "basic challenge is not a bearer challenge",
+			header: `Basic realm="registry"`,
+			wantOK: false,
+		},
+		{
+			name:   "empty header",
+			header: "",
+			wantOK: false,
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			got, ok := parseWWWAuthenticateBearer(tt.header)
+			if ok != tt.wantOK {
+				t.Fatalf("parseWWWAuthenticateBearer(%q) ok = %v, want %v", tt.header, ok, tt.wantOK)
+			}
+			if ok && got != tt.want {
+				t.Errorf("parseWWWAuthenticateBearer(%q) = %+v, want %+v", tt.header, got, tt.want)
+			}
+		})
+	}
+}
+
+// registryTestServer fakes a registry that challenges the first manifest
+// request with a Bearer WWW-Authenticate header, matching how Docker Hub,
+// ECR, GCR, GHCR and Quay behave even for anonymous pulls of public images.
+func registryTestServer(t *testing.T, manifestExists bool) *httptest.Server {
+	t.Helper()
+
+	var tokenURL string
+	mux := http.NewServeMux()
+	mux.HandleFunc("/token", func(w http.ResponseWriter, r *http.Request) {
+		w.Header().Set("Content-Type", "application/json")
+		fmt.Fprint(w, `{"token":"test-bearer-token"}`)
+	})
+	mux.HandleFunc("/v2/app/manifests/v1.0.0", func(w http.ResponseWriter, r *http.Request) {
+		if r.Header.Get("Authorization") != "Bearer test-bearer-token" {
+			w.Header().Set("WWW-Authenticate", fmt.Sprintf(`Bearer realm="%s",service="test-registry",scope="repository:library/app:pull"`, tokenURL))
+			w.WriteHeader(http.StatusUnauthorized)
+			return
+		}
+		if !manifestExists {
+			w.WriteHeader(http.StatusNotFound)
+			return
+		}
+		w.WriteHeader(http.StatusOK)
+	})
+
+	server := httptest.NewTLSServer(mux)
+	tokenURL = server.URL + "/token"
+	t.Cleanup(server.Close)
+	return server
+}
+
+func withRegistryHTTPClient(t *testing.T, client *http.Client) {
+	t.Helper()
+	previous := registryHTTPClient
+	registryHTTPClient = client
+	t.Cleanup(func() { registryHTTPClient = previous })
+}
+
+func TestDefaultManifestChecker_Exists(t *testing.T) {
+	t.Run("completes the bearer challenge and reports an existing image", func(t *testing.T) {
+		server := registryTestServer(t, true)
+		withRegistryHTTPClient(t, server.Client())
+
+		ref := ImageReference{Domain: strings.TrimPrefix(server.URL, "https://"), Path: "app", Tag: "v1.0.0"}
+		exists, err := (defaultManifestChecker{}).Exists(context.Background(), ref, nil)
+		if err != nil {
+			t.Fatalf("Exists() error = %v", err)
+		}
+		if !exists {
+			t.Error("Exists() = false, want true for an image the registry has after the bearer-token retry")
+		}
+	})
+
+	t.Run("completes the bearer challenge and reports a missing image", func(t *testing.T) {
+		server := registryTestServer(t, false)
+		withRegistryHTTPClient(t, server.Client())
+
+		ref := ImageReference{Domain: strings.TrimPrefix(server.URL, "https://"), Path: "app", Tag: "v1.0.0"}
+		exists, err := (defaultManifestChecker{}).Exists(context.Background(), ref, nil)
+		if err != nil {
+			t.Fatalf("Exists() error = %v", err)
+		}
+		if exists {
+			t.Error("Exists() = true, want false for a 404 after the bearer-token retry")
+		}
+	})
+
+	t.Run("a 401 without a bearer challenge is an error, not a missing image", func(t *testing.T) {
+		server := httptest.NewTLSServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+			w.WriteHeader(http.StatusUnauthorized)
+		}))
+		defer server.Close()
+		withRegistryHTTPClient(t, server.Client())
+
+		ref := ImageReference{Domain: strings.TrimPrefix(server.URL, "https://"), Path: "app", Tag: "v1.0.0"}
+		exists, err := (defaultManifestChecker{}).Exists(context.Background(), ref, nil)
+		if err == nil {
+			t.Fatal("Exists() error = nil, want error for an unchallenged 401")
+		}
+		if exists {
+			t.Error("Exists() = true, want false alongside the error")
+		}
+	})
+}
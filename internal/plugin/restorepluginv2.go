@@ -1,26 +1,139 @@
 package plugin
 
 import (
+	"encoding/json"
+	"fmt"
 	"strings"
+	"sync"
 
 	"github.com/pkg/errors"
 	"github.com/sirupsen/logrus"
 	v1 "github.com/vmware-tanzu/velero/pkg/apis/velero/v1"
 	"github.com/vmware-tanzu/velero/pkg/plugin/velero"
 	apps "k8s.io/api/apps/v1"
+	batch "k8s.io/api/batch/v1"
 	corev1 "k8s.io/api/core/v1"
 	"k8s.io/apimachinery/pkg/apis/meta/v1/unstructured"
 	"k8s.io/apimachinery/pkg/runtime"
+	"k8s.io/client-go/kubernetes"
 )
 
+// containerImageAnnotation is the annotation that drives RestorePluginV2.
+const containerImageAnnotation = "eth-eks.velero/container-images"
+
+// imageRulesConfigMapAnnotation, set on the Restore CR, points at the ConfigMap
+// holding cluster-wide image rewrite rules (namespace/name).
+const imageRulesConfigMapAnnotation = "eth-eks.velero/image-rules-configmap"
+
+// validateImageAnnotation opts an object into registry validation of its
+// rewritten images before they're applied; validateImagePolicyAnnotation
+// controls what happens when that validation fails. Both can also be set
+// cluster-wide via the rules ConfigMap -- see RuleSet.ValidateImage.
+const validateImageAnnotation = "eth-eks.velero/validate-image"
+const validateImagePolicyAnnotation = "eth-eks.velero/validate-image-policy"
+
 // RestorePluginV2 is a restore item action plugin for Velero.
 type RestorePluginV2 struct {
 	log logrus.FieldLogger
+
+	kubeClient kubernetes.Interface
+	ruleSets   map[string]*RuleSet
+	ruleSetsMu sync.Mutex
+
+	// reports accumulates the per-restore audit trail of image changes,
+	// keyed by restore UID. flushOnces ensures each restore's result
+	// ConfigMap write is attempted at most once. See auditreport.go.
+	reports    sync.Map
+	flushOnces sync.Map
+
+	// manifestChecker talks to container registries to validate rewritten
+	// images; nil defaults to defaultManifestChecker. validateCache caches
+	// validation results per restore UID for the lifetime of the restore.
+	// See imagevalidate.go.
+	manifestChecker ManifestChecker
+	validateCache   sync.Map
 }
 
 // NewRestorePluginV2 instantiates a v2 RestorePlugin.
 func NewRestorePluginV2(log logrus.FieldLogger) *RestorePluginV2 {
-	return &RestorePluginV2{log: log}
+	return &RestorePluginV2{
+		log:      log,
+		ruleSets: map[string]*RuleSet{},
+	}
+}
+
+// workloadKind describes how to instantiate a resource of a given Kind and how
+// to reach into it to find the PodSpec whose containers should be rewritten.
+type workloadKind struct {
+	newResource func() runtime.Object
+	podSpec     func(resource runtime.Object) *corev1.PodSpec
+}
+
+// workloadKinds maps a Kind to its workloadKind descriptor. Adding support for a
+// new workload is a matter of adding one entry here (plus tests).
+var workloadKinds = map[string]workloadKind{
+	"StatefulSet": {
+		newResource: func() runtime.Object { return &apps.StatefulSet{} },
+		podSpec: func(resource runtime.Object) *corev1.PodSpec {
+			return &resource.(*apps.StatefulSet).Spec.Template.Spec
+		},
+	},
+	"Deployment": {
+		newResource: func() runtime.Object { return &apps.Deployment{} },
+		podSpec: func(resource runtime.Object) *corev1.PodSpec {
+			return &resource.(*apps.Deployment).Spec.Template.Spec
+		},
+	},
+	"DaemonSet": {
+		newResource: func() runtime.Object { return &apps.DaemonSet{} },
+		podSpec: func(resource runtime.Object) *corev1.PodSpec {
+			return &resource.(*apps.DaemonSet).Spec.Template.Spec
+		},
+	},
+	"ReplicaSet": {
+		newResource: func() runtime.Object { return &apps.ReplicaSet{} },
+		podSpec: func(resource runtime.Object) *corev1.PodSpec {
+			return &resource.(*apps.ReplicaSet).Spec.Template.Spec
+		},
+	},
+	"Job": {
+		newResource: func() runtime.Object { return &batch.Job{} },
+		podSpec: func(resource runtime.Object) *corev1.PodSpec {
+			return &resource.(*batch.Job).Spec.Template.Spec
+		},
+	},
+	"CronJob": {
+		newResource: func() runtime.Object { return &batch.CronJob{} },
+		podSpec: func(resource runtime.Object) *corev1.PodSpec {
+			return &resource.(*batch.CronJob).Spec.JobTemplate.Spec.Template.Spec
+		},
+	},
+	"Pod": {
+		newResource: func() runtime.Object { return &corev1.Pod{} },
+		podSpec: func(resource runtime.Object) *corev1.PodSpec {
+			return &resource.(*corev1.Pod).Spec
+		},
+	},
+}
+
+// imageOverrides is the parsed form of the container-images annotation. Either
+// uniform is set (the legacy "replace every container" form) or perContainer is
+// set (the JSON object form, keyed by container name), never both.
+type imageOverrides struct {
+	uniform      string
+	perContainer map[string]string
+}
+
+// imageFor returns the replacement image for a container with the given name,
+// and whether that container should be touched at all. In uniform mode every
+// container matches; in per-container mode only containers with a matching key
+// do, so others are left untouched.
+func (o imageOverrides) imageFor(containerName string) (string, bool) {
+	if o.perContainer != nil {
+		image, ok := o.perContainer[containerName]
+		return image, ok
+	}
+	return o.uniform, true
 }
 
 // Name is required to implement the interface, but the Velero pod does not delegate this
@@ -37,20 +150,36 @@ func (p *RestorePluginV2) Name() string {
 // selector. A zero-valued ResourceSelector matches all resources.
 func (p *RestorePluginV2) AppliesTo() (velero.ResourceSelector, error) {
 	return velero.ResourceSelector{
-		IncludedResources: []string{"statefulsets", "deployments"},
+		IncludedResources: []string{"statefulsets", "deployments", "cronjobs", "jobs", "daemonsets", "replicasets", "pods"},
 	}, nil
 }
 
 // Execute allows the RestorePlugin to perform arbitrary logic with the item being restored
 func (p *RestorePluginV2) Execute(input *velero.RestoreItemActionExecuteInput) (*velero.RestoreItemActionExecuteOutput, error) {
 	item := input.Item.(*unstructured.Unstructured)
-	newImage, exists := p.getImageAnnotation(item)
-	if !exists {
+	kind := item.GetObjectKind().GroupVersionKind().Kind
+
+	// Per-object annotations take precedence over the cluster-wide rules
+	// ConfigMap; only fall back to rules when the object carries no annotation.
+	overrides, hasAnnotation := p.getImageAnnotation(item)
+
+	// The rules ConfigMap is also where cluster-wide validation defaults live
+	// (RuleSet.ValidateImage), so it's loaded whenever the restore references
+	// one, even if this particular object is driven by its own annotation.
+	var ruleSet *RuleSet
+	if ref, ok := imageRulesConfigMapRef(input.Restore); ok {
+		rs, err := p.getRuleSet(ref)
+		if err != nil {
+			return nil, err
+		}
+		ruleSet = rs
+	}
+
+	if !hasAnnotation && ruleSet == nil {
 		return velero.NewRestoreItemActionExecuteOutput(input.Item), nil
 	}
 
-	kind := item.GetObjectKind().GroupVersionKind().Kind
-	resource, err := p.createResource(kind)
+	resource, podSpec, err := p.createResource(kind)
 	if err != nil {
 		return nil, err
 	}
@@ -59,76 +188,255 @@ func (p *RestorePluginV2) Execute(input *velero.RestoreItemActionExecuteInput) (
 		return nil, errors.WithStack(err)
 	}
 
-	if err := p.updateContainerImages(resource, newImage, kind); err != nil {
+	namespace, name := item.GetNamespace(), item.GetName()
+	spec := podSpec(resource)
+
+	validateEnabled, validatePolicy := validationPolicy(item, ruleSet)
+	validate := p.buildImageValidator(input.Restore, namespace, spec.ImagePullSecrets, validateEnabled, validatePolicy)
+
+	changed := false
+	record := func(containerName, oldImage, newImage, trigger string) {
+		changed = true
+		p.log.WithFields(logrus.Fields{
+			"namespace": namespace,
+			"kind":      kind,
+			"name":      name,
+			"container": containerName,
+			"oldImage":  oldImage,
+			"newImage":  newImage,
+			"trigger":   trigger,
+		}).Info("rewrote container image")
+		p.recordChange(input.Restore, ImageChange{
+			Namespace: namespace,
+			Kind:      kind,
+			Name:      name,
+			Container: containerName,
+			OldImage:  oldImage,
+			NewImage:  newImage,
+			Trigger:   trigger,
+		})
+	}
+
+	if hasAnnotation {
+		if err := p.updateContainerImages(spec, overrides, record, validate); err != nil {
+			return nil, err
+		}
+	} else {
+		if err := p.applyRuleSet(spec, ruleSet, namespace, kind, record, validate); err != nil {
+			return nil, err
+		}
+	}
+
+	output, err := p.createOutput(resource)
+	if err != nil {
 		return nil, err
 	}
 
-	return p.createOutput(resource)
+	// Velero only polls Progress for operations whose OperationID came back
+	// non-empty from Execute, so that's how the audit ConfigMap flush (see
+	// auditreport.go) actually gets triggered -- recordChange alone isn't
+	// enough to make Velero call back into the plugin.
+	if changed && input.Restore != nil {
+		output = output.WithOperationID(imageRewriteOperationID(namespace, kind, name))
+	}
+
+	return output, nil
+}
+
+// imageRewriteOperationID identifies the (no-op, already-complete) async
+// operation Execute registers for an item it rewrote at least one image on,
+// purely so Velero's operations controller calls back into Progress.
+func imageRewriteOperationID(namespace, kind, name string) string {
+	return fmt.Sprintf("image-rewrite/%s/%s/%s", namespace, kind, name)
+}
+
+// imageRulesConfigMapRef reads the ConfigMap reference from the Restore CR's
+// image-rules-configmap annotation, in "namespace/name" form.
+func imageRulesConfigMapRef(restore *v1.Restore) (string, bool) {
+	if restore == nil {
+		return "", false
+	}
+	ref, exists := restore.Annotations[imageRulesConfigMapAnnotation]
+	return ref, exists && ref != ""
 }
 
-func (p *RestorePluginV2) getImageAnnotation(item *unstructured.Unstructured) (string, bool) {
+// getImageAnnotation reads the container-images annotation and parses it as
+// either a bare image reference (applied to every container) or a JSON object
+// mapping container name to image reference. The legacy singular
+// "eth-eks.velero/container-image" annotation is still accepted as a synonym
+// for the bare form.
+func (p *RestorePluginV2) getImageAnnotation(item *unstructured.Unstructured) (imageOverrides, bool) {
 	metadata := item.UnstructuredContent()["metadata"].(map[string]interface{})
 	annotations, _ := metadata["annotations"].(map[string]interface{})
-	value, exists := annotations["eth-eks.velero/container-image"]
+
+	value, exists := annotations[containerImageAnnotation]
 	if !exists {
-		return "", false
+		value, exists = annotations["eth-eks.velero/container-image"]
 	}
-	newImage, ok := value.(string)
+	if !exists {
+		return imageOverrides{}, false
+	}
+
+	raw, ok := value.(string)
 	if !ok {
 		p.log.Warning("Image annotation value is not a string")
-		return "", false
+		return imageOverrides{}, false
 	}
-	return newImage, true
+
+	trimmed := strings.TrimSpace(raw)
+	if strings.HasPrefix(trimmed, "{") {
+		var perContainer map[string]string
+		if err := json.Unmarshal([]byte(trimmed), &perContainer); err != nil {
+			p.log.Warningf("Image annotation looks like a JSON object but failed to parse: %v", err)
+			return imageOverrides{}, false
+		}
+		return imageOverrides{perContainer: perContainer}, true
+	}
+
+	return imageOverrides{uniform: trimmed}, true
 }
 
-func (p *RestorePluginV2) updateContainerImages(resource interface{}, newImage string, kind string) error {
-	var containers []corev1.Container
-	switch kind {
-	case "StatefulSet":
-		sts := resource.(*apps.StatefulSet)
-		containers = sts.Spec.Template.Spec.Containers
-	case "Deployment":
-		deploy := resource.(*apps.Deployment)
-		containers = deploy.Spec.Template.Spec.Containers
-	default:
-		return errors.Errorf("unsupported kind %s", kind)
+// imageChangeFunc is notified of every container image rewritten by
+// updateContainerImages or applyRuleSet, so callers can audit or log the
+// change. trigger identifies what caused the rewrite (e.g. "annotation" or a
+// rules ConfigMap rule name).
+type imageChangeFunc func(containerName, oldImage, newImage, trigger string)
+
+// updateContainerImages rewrites the image of every container, initContainer
+// and ephemeralContainer in the given PodSpec that matches overrides, logging
+// a warning for any per-container key that didn't match a container. If
+// validate rejects a rewrite under the "fail" policy it returns an error,
+// aborting the rest of the restore item; under "warn" it leaves that
+// container's image untouched and continues.
+func (p *RestorePluginV2) updateContainerImages(spec *corev1.PodSpec, overrides imageOverrides, record imageChangeFunc, validate imageValidator) error {
+	matched := map[string]bool{}
+
+	if err := p.updateContainers(spec.Containers, overrides, matched, record, validate); err != nil {
+		return err
+	}
+	if err := p.updateContainers(spec.InitContainers, overrides, matched, record, validate); err != nil {
+		return err
 	}
 
-	for i := range containers {
-		currentImage := containers[i].Image
-		// Keep the existing tag if present
-		if tag := p.getImageTag(currentImage); tag != "" {
-			if newTag := p.getImageTag(newImage); newTag == "" {
-				newImage = newImage + ":" + tag
+	for i := range spec.EphemeralContainers {
+		ec := &spec.EphemeralContainers[i]
+		newImage, ok := overrides.imageFor(ec.Name)
+		if !ok {
+			continue
+		}
+		matched[ec.Name] = true
+		image := resolveImage(ec.Image, newImage)
+		if validate != nil {
+			apply, err := validate(ec.Name, ec.Image, image)
+			if err != nil {
+				return err
+			}
+			if !apply {
+				continue
 			}
 		}
-		p.log.Infof("Updating container image from %s to %s", currentImage, newImage)
-		containers[i].Image = newImage
+		record(ec.Name, ec.Image, image, "annotation")
+		ec.Image = image
+	}
+
+	if overrides.perContainer == nil {
+		return nil
+	}
+	for name := range overrides.perContainer {
+		if !matched[name] {
+			p.log.Warnf("%s annotation references container %q, which was not found on this resource", containerImageAnnotation, name)
+		}
 	}
+	return nil
+}
 
+func (p *RestorePluginV2) updateContainers(containers []corev1.Container, overrides imageOverrides, matched map[string]bool, record imageChangeFunc, validate imageValidator) error {
+	for i := range containers {
+		newImage, ok := overrides.imageFor(containers[i].Name)
+		if !ok {
+			continue
+		}
+		matched[containers[i].Name] = true
+		image := resolveImage(containers[i].Image, newImage)
+		if validate != nil {
+			apply, err := validate(containers[i].Name, containers[i].Image, image)
+			if err != nil {
+				return err
+			}
+			if !apply {
+				continue
+			}
+		}
+		record(containers[i].Name, containers[i].Image, image, "annotation")
+		containers[i].Image = image
+	}
 	return nil
 }
 
-func (p *RestorePluginV2) getImageTag(image string) string {
-	parts := strings.Split(image, ":")
-	if len(parts) > 1 {
-		return parts[1]
+// applyRuleSet rewrites every container, initContainer and ephemeralContainer
+// image in spec that matches a rule in rs. See updateContainerImages for how
+// validate affects rewrites.
+func (p *RestorePluginV2) applyRuleSet(spec *corev1.PodSpec, rs *RuleSet, namespace, kind string, record imageChangeFunc, validate imageValidator) error {
+	rewrite := func(containers []corev1.Container) error {
+		for i := range containers {
+			newImage, trigger, changed := rs.Rewrite(namespace, kind, containers[i].Name, containers[i].Image)
+			if !changed {
+				continue
+			}
+			if validate != nil {
+				apply, err := validate(containers[i].Name, containers[i].Image, newImage)
+				if err != nil {
+					return err
+				}
+				if !apply {
+					continue
+				}
+			}
+			record(containers[i].Name, containers[i].Image, newImage, trigger)
+			containers[i].Image = newImage
+		}
+		return nil
+	}
+
+	if err := rewrite(spec.Containers); err != nil {
+		return err
+	}
+	if err := rewrite(spec.InitContainers); err != nil {
+		return err
 	}
-	return ""
+
+	for i := range spec.EphemeralContainers {
+		ec := &spec.EphemeralContainers[i]
+		newImage, trigger, changed := rs.Rewrite(namespace, kind, ec.Name, ec.Image)
+		if !changed {
+			continue
+		}
+		if validate != nil {
+			apply, err := validate(ec.Name, ec.Image, newImage)
+			if err != nil {
+				return err
+			}
+			if !apply {
+				continue
+			}
+		}
+		record(ec.Name, ec.Image, newImage, trigger)
+		ec.Image = newImage
+	}
+	return nil
 }
 
-func (p *RestorePluginV2) createResource(kind string) (interface{}, error) {
-	switch kind {
-	case "StatefulSet":
-		p.log.Infof("Creating StatefulSet resource")
-		return &apps.StatefulSet{}, nil
-	case "Deployment":
-		p.log.Infof("Creating Deployment resource")
-		return &apps.Deployment{}, nil
-	default:
+// createResource instantiates the runtime.Object for kind and returns a function to
+// reach its PodSpec.
+func (p *RestorePluginV2) createResource(kind string) (runtime.Object, func(runtime.Object) *corev1.PodSpec, error) {
+	wk, ok := workloadKinds[kind]
+	if !ok {
 		p.log.Infof("Unsupported kind: %s", kind)
-		return nil, errors.Errorf("unsupported kind %s", kind)
+		return nil, nil, errors.Errorf("unsupported kind %s", kind)
 	}
+
+	p.log.Infof("Creating %s resource", kind)
+	return wk.newResource(), wk.podSpec, nil
 }
 
 func (p *RestorePluginV2) createOutput(resource interface{}) (*velero.RestoreItemActionExecuteOutput, error) {
@@ -140,7 +448,15 @@ func (p *RestorePluginV2) createOutput(resource interface{}) (*velero.RestoreIte
 	return velero.NewRestoreItemActionExecuteOutput(&unstructured.Unstructured{Object: inputMap}), nil
 }
 
-func (p *RestorePluginV2) Progress(_ string, _ *v1.Restore) (velero.OperationProgress, error) {
+// Progress reports the (already complete) no-op operation Execute registers
+// for items it rewrote an image on, and flushes that restore's audit result
+// ConfigMap on the first call. operationID is unused: flushReport already
+// keys and deduplicates by restore, which is enough since one restore's items
+// all resolve to the same ConfigMap.
+func (p *RestorePluginV2) Progress(_ string, restore *v1.Restore) (velero.OperationProgress, error) {
+	if err := p.flushReport(restore); err != nil {
+		p.log.Warnf("Failed to write image rewrite result configmap for restore %s: %v", restore.Name, err)
+	}
 	return velero.OperationProgress{Completed: true}, nil
 }
 
@@ -1,10 +1,13 @@
 package plugin
 
 import (
+	"context"
+	"encoding/json"
 	"reflect"
 	"testing"
 
 	"github.com/sirupsen/logrus"
+	velerov1 "github.com/vmware-tanzu/velero/pkg/apis/velero/v1"
 	"github.com/vmware-tanzu/velero/pkg/plugin/velero"
 	appsv1 "k8s.io/api/apps/v1"
 	batchv1 "k8s.io/api/batch/v1"
@@ -12,16 +15,18 @@ import (
 	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
 	"k8s.io/apimachinery/pkg/apis/meta/v1/unstructured"
 	"k8s.io/apimachinery/pkg/runtime"
+	"k8s.io/apimachinery/pkg/types"
+	"k8s.io/client-go/kubernetes/fake"
 )
 
 func TestRestorePluginV2_AppliesTo(t *testing.T) {
-	t.Run("Only applies to Deployments and StatefulSets and CronJobs", func(t *testing.T) {
+	t.Run("Applies to every supported workload kind", func(t *testing.T) {
 		plugin := &RestorePluginV2{
 			log: logrus.New(),
 		}
 
 		want := velero.ResourceSelector{
-			IncludedResources: []string{"statefulsets", "deployments", "cronjobs"},
+			IncludedResources: []string{"statefulsets", "deployments", "cronjobs", "jobs", "daemonsets", "replicasets", "pods"},
 		}
 		got, err := plugin.AppliesTo()
 		if err != nil {
@@ -259,4 +264,492 @@ func TestRestorePluginV2_Execute(t *testing.T) {
 			t.Errorf("Execute() got image = %v, want %v", got, want)
 		}
 	})
+
+	t.Run("Updates Job container image", func(t *testing.T) {
+		job := batchv1.Job{
+			ObjectMeta: metav1.ObjectMeta{
+				Name:      "test-job",
+				Namespace: "test-namespace",
+				Annotations: map[string]string{
+					"eth-eks.velero/container-image": "new-registry/app:v1.0.0",
+				},
+			},
+			Spec: batchv1.JobSpec{
+				Template: corev1.PodTemplateSpec{
+					Spec: corev1.PodSpec{
+						Containers: []corev1.Container{
+							{
+								Name:  "app",
+								Image: "old-registry/app:v0.9.0",
+							},
+						},
+					},
+				},
+			},
+		}
+
+		jobUnstructured, err := runtime.DefaultUnstructuredConverter.ToUnstructured(&job)
+		if err != nil {
+			t.Errorf("Error converting Job to unstructured: %v", err)
+		}
+		jobUnstructured["kind"] = "Job"
+
+		input := &velero.RestoreItemActionExecuteInput{
+			Item: &unstructured.Unstructured{
+				Object: jobUnstructured,
+			},
+		}
+
+		plugin := &RestorePluginV2{
+			log: logrus.New(),
+		}
+
+		output, err := plugin.Execute(input)
+		if err != nil {
+			t.Errorf("Error executing plugin: %v", err)
+		}
+
+		var updatedJob batchv1.Job
+		if err := runtime.DefaultUnstructuredConverter.FromUnstructured(output.UpdatedItem.UnstructuredContent(), &updatedJob); err != nil {
+			t.Errorf("Error converting output to Job: %v", err)
+		}
+
+		got := updatedJob.Spec.Template.Spec.Containers[0].Image
+		want := "new-registry/app:v1.0.0"
+		if got != want {
+			t.Errorf("Execute() got image = %v, want %v", got, want)
+		}
+	})
+
+	t.Run("Updates DaemonSet and ReplicaSet container images", func(t *testing.T) {
+		for _, tc := range []struct {
+			kind     string
+			resource runtime.Object
+			getImage func(runtime.Object) string
+		}{
+			{
+				kind: "DaemonSet",
+				resource: &appsv1.DaemonSet{
+					ObjectMeta: metav1.ObjectMeta{
+						Name:      "test-daemonset",
+						Namespace: "test-namespace",
+						Annotations: map[string]string{
+							"eth-eks.velero/container-image": "new-registry/app",
+						},
+					},
+					Spec: appsv1.DaemonSetSpec{
+						Template: corev1.PodTemplateSpec{
+							Spec: corev1.PodSpec{
+								Containers: []corev1.Container{
+									{Name: "app", Image: "old-registry/app:v1.2.3"},
+								},
+							},
+						},
+					},
+				},
+				getImage: func(obj runtime.Object) string {
+					return obj.(*appsv1.DaemonSet).Spec.Template.Spec.Containers[0].Image
+				},
+			},
+			{
+				kind: "ReplicaSet",
+				resource: &appsv1.ReplicaSet{
+					ObjectMeta: metav1.ObjectMeta{
+						Name:      "test-replicaset",
+						Namespace: "test-namespace",
+						Annotations: map[string]string{
+							"eth-eks.velero/container-image": "new-registry/app",
+						},
+					},
+					Spec: appsv1.ReplicaSetSpec{
+						Template: corev1.PodTemplateSpec{
+							Spec: corev1.PodSpec{
+								Containers: []corev1.Container{
+									{Name: "app", Image: "old-registry/app:v1.2.3"},
+								},
+							},
+						},
+					},
+				},
+				getImage: func(obj runtime.Object) string {
+					return obj.(*appsv1.ReplicaSet).Spec.Template.Spec.Containers[0].Image
+				},
+			},
+		} {
+			resourceUnstructured, err := runtime.DefaultUnstructuredConverter.ToUnstructured(tc.resource)
+			if err != nil {
+				t.Errorf("Error converting %s to unstructured: %v", tc.kind, err)
+				continue
+			}
+			resourceUnstructured["kind"] = tc.kind
+
+			input := &velero.RestoreItemActionExecuteInput{
+				Item: &unstructured.Unstructured{
+					Object: resourceUnstructured,
+				},
+			}
+
+			plugin := &RestorePluginV2{
+				log: logrus.New(),
+			}
+
+			output, err := plugin.Execute(input)
+			if err != nil {
+				t.Errorf("Error executing plugin for %s: %v", tc.kind, err)
+				continue
+			}
+
+			updated := tc.resource
+			if err := runtime.DefaultUnstructuredConverter.FromUnstructured(output.UpdatedItem.UnstructuredContent(), updated); err != nil {
+				t.Errorf("Error converting output to %s: %v", tc.kind, err)
+				continue
+			}
+
+			got := tc.getImage(updated)
+			want := "new-registry/app:v1.2.3"
+			if got != want {
+				t.Errorf("Execute() for %s got image = %v, want %v", tc.kind, got, want)
+			}
+		}
+	})
+
+	t.Run("Updates bare Pod image including initContainers", func(t *testing.T) {
+		pod := corev1.Pod{
+			ObjectMeta: metav1.ObjectMeta{
+				Name:      "test-pod",
+				Namespace: "test-namespace",
+				Annotations: map[string]string{
+					"eth-eks.velero/container-image": "new-registry/app:v1.0.0",
+				},
+			},
+			Spec: corev1.PodSpec{
+				InitContainers: []corev1.Container{
+					{Name: "init", Image: "old-registry/app:v0.1.0"},
+				},
+				Containers: []corev1.Container{
+					{Name: "app", Image: "old-registry/app:v0.9.0"},
+				},
+			},
+		}
+
+		podUnstructured, err := runtime.DefaultUnstructuredConverter.ToUnstructured(&pod)
+		if err != nil {
+			t.Errorf("Error converting Pod to unstructured: %v", err)
+		}
+		podUnstructured["kind"] = "Pod"
+
+		input := &velero.RestoreItemActionExecuteInput{
+			Item: &unstructured.Unstructured{
+				Object: podUnstructured,
+			},
+		}
+
+		plugin := &RestorePluginV2{
+			log: logrus.New(),
+		}
+
+		output, err := plugin.Execute(input)
+		if err != nil {
+			t.Errorf("Error executing plugin: %v", err)
+		}
+
+		var updatedPod corev1.Pod
+		if err := runtime.DefaultUnstructuredConverter.FromUnstructured(output.UpdatedItem.UnstructuredContent(), &updatedPod); err != nil {
+			t.Errorf("Error converting output to Pod: %v", err)
+		}
+
+		if got, want := updatedPod.Spec.Containers[0].Image, "new-registry/app:v1.0.0"; got != want {
+			t.Errorf("Execute() got container image = %v, want %v", got, want)
+		}
+		if got, want := updatedPod.Spec.InitContainers[0].Image, "new-registry/app:v1.0.0"; got != want {
+			t.Errorf("Execute() got initContainer image = %v, want %v", got, want)
+		}
+	})
+
+	t.Run("Applies per-container image overrides from JSON annotation and leaves unmatched containers alone", func(t *testing.T) {
+		deployment := appsv1.Deployment{
+			ObjectMeta: metav1.ObjectMeta{
+				Name:      "test-deployment",
+				Namespace: "test-namespace",
+				Annotations: map[string]string{
+					containerImageAnnotation: `{"app":"new-registry/app","sidecar":"new-registry/sidecar@sha256:abc123"}`,
+				},
+			},
+			Spec: appsv1.DeploymentSpec{
+				Template: corev1.PodTemplateSpec{
+					Spec: corev1.PodSpec{
+						Containers: []corev1.Container{
+							{Name: "app", Image: "old-registry/app:v1.2.3"},
+							{Name: "sidecar", Image: "old-registry/sidecar:v1.0.0"},
+							{Name: "logger", Image: "old-registry/logger:v1.0.0"},
+						},
+					},
+				},
+			},
+		}
+
+		deploymentUnstructured, err := runtime.DefaultUnstructuredConverter.ToUnstructured(&deployment)
+		if err != nil {
+			t.Errorf("Error converting Deployment to unstructured: %v", err)
+		}
+		deploymentUnstructured["kind"] = "Deployment"
+
+		input := &velero.RestoreItemActionExecuteInput{
+			Item: &unstructured.Unstructured{
+				Object: deploymentUnstructured,
+			},
+		}
+
+		plugin := &RestorePluginV2{
+			log: logrus.New(),
+		}
+
+		output, err := plugin.Execute(input)
+		if err != nil {
+			t.Errorf("Error executing plugin: %v", err)
+		}
+
+		var updatedDeployment appsv1.Deployment
+		if err := runtime.DefaultUnstructuredConverter.FromUnstructured(output.UpdatedItem.UnstructuredContent(), &updatedDeployment); err != nil {
+			t.Errorf("Error converting output to Deployment: %v", err)
+		}
+
+		containers := updatedDeployment.Spec.Template.Spec.Containers
+		if got, want := containers[0].Image, "new-registry/app:v1.2.3"; got != want {
+			t.Errorf("Execute() got app image = %v, want %v", got, want)
+		}
+		if got, want := containers[1].Image, "new-registry/sidecar@sha256:abc123"; got != want {
+			t.Errorf("Execute() got sidecar image = %v, want %v", got, want)
+		}
+		if got, want := containers[2].Image, "old-registry/logger:v1.0.0"; got != want {
+			t.Errorf("Execute() got logger image = %v, want %v (unmatched container should be untouched)", got, want)
+		}
+	})
+
+	t.Run("Falls back to cluster-wide rules ConfigMap when no annotation is present", func(t *testing.T) {
+		configMap := &corev1.ConfigMap{
+			ObjectMeta: metav1.ObjectMeta{
+				Name:      "image-rewrite-rules",
+				Namespace: "velero",
+			},
+			Data: map[string]string{
+				"rules.yaml": `
+rules:
+  - match: {namespaces: ["prod-*"], kinds: ["Deployment"]}
+    rewrite: {fromRegistry: "old-registry.io", toRegistry: "new-registry.internal"}
+`,
+			},
+		}
+
+		deployment := appsv1.Deployment{
+			ObjectMeta: metav1.ObjectMeta{
+				Name:      "test-deployment",
+				Namespace: "prod-payments",
+			},
+			Spec: appsv1.DeploymentSpec{
+				Template: corev1.PodTemplateSpec{
+					Spec: corev1.PodSpec{
+						Containers: []corev1.Container{
+							{Name: "app", Image: "old-registry.io/app:v1"},
+						},
+					},
+				},
+			},
+		}
+
+		deploymentUnstructured, err := runtime.DefaultUnstructuredConverter.ToUnstructured(&deployment)
+		if err != nil {
+			t.Errorf("Error converting Deployment to unstructured: %v", err)
+		}
+		deploymentUnstructured["kind"] = "Deployment"
+
+		input := &velero.RestoreItemActionExecuteInput{
+			Item: &unstructured.Unstructured{
+				Object: deploymentUnstructured,
+			},
+			Restore: &velerov1.Restore{
+				ObjectMeta: metav1.ObjectMeta{
+					Annotations: map[string]string{
+						imageRulesConfigMapAnnotation: "velero/image-rewrite-rules",
+					},
+				},
+			},
+		}
+
+		plugin := &RestorePluginV2{
+			log:        logrus.New(),
+			kubeClient: fake.NewSimpleClientset(configMap),
+			ruleSets:   map[string]*RuleSet{},
+		}
+
+		output, err := plugin.Execute(input)
+		if err != nil {
+			t.Errorf("Error executing plugin: %v", err)
+		}
+
+		var updatedDeployment appsv1.Deployment
+		if err := runtime.DefaultUnstructuredConverter.FromUnstructured(output.UpdatedItem.UnstructuredContent(), &updatedDeployment); err != nil {
+			t.Errorf("Error converting output to Deployment: %v", err)
+		}
+
+		got := updatedDeployment.Spec.Template.Spec.Containers[0].Image
+		want := "new-registry.internal/app:v1"
+		if got != want {
+			t.Errorf("Execute() got image = %v, want %v", got, want)
+		}
+	})
+}
+
+func TestRestorePluginV2_AuditReport(t *testing.T) {
+	t.Run("Progress writes a result configmap recording every image change", func(t *testing.T) {
+		deployment := appsv1.Deployment{
+			ObjectMeta: metav1.ObjectMeta{
+				Name:      "test-deployment",
+				Namespace: "test-namespace",
+				Annotations: map[string]string{
+					"eth-eks.velero/container-image": "new-registry/app",
+				},
+			},
+			Spec: appsv1.DeploymentSpec{
+				Template: corev1.PodTemplateSpec{
+					Spec: corev1.PodSpec{
+						Containers: []corev1.Container{
+							{Name: "app", Image: "old-registry/app:v1.2.3"},
+						},
+					},
+				},
+			},
+		}
+
+		deploymentUnstructured, err := runtime.DefaultUnstructuredConverter.ToUnstructured(&deployment)
+		if err != nil {
+			t.Errorf("Error converting Deployment to unstructured: %v", err)
+		}
+		deploymentUnstructured["kind"] = "Deployment"
+
+		restore := &velerov1.Restore{
+			ObjectMeta: metav1.ObjectMeta{
+				Name:      "test-restore",
+				Namespace: "velero",
+				UID:       types.UID("test-restore-uid"),
+			},
+		}
+
+		input := &velero.RestoreItemActionExecuteInput{
+			Item: &unstructured.Unstructured{
+				Object: deploymentUnstructured,
+			},
+			Restore: restore,
+		}
+
+		clientset := fake.NewSimpleClientset()
+		plugin := &RestorePluginV2{
+			log:        logrus.New(),
+			kubeClient: clientset,
+			ruleSets:   map[string]*RuleSet{},
+		}
+
+		output, err := plugin.Execute(input)
+		if err != nil {
+			t.Errorf("Error executing plugin: %v", err)
+		}
+
+		// Velero only calls Progress for an item when Execute's output came
+		// back with a non-empty OperationID -- exercise that actual contract
+		// rather than calling Progress directly, since that's what makes the
+		// flush happen in a real restore.
+		if output.OperationID == "" {
+			t.Fatal("Execute() OperationID = \"\", want non-empty so Velero polls Progress and the result configmap actually gets flushed")
+		}
+
+		if _, err := plugin.Progress(output.OperationID, restore); err != nil {
+			t.Errorf("Error calling Progress: %v", err)
+		}
+
+		resultConfigMap, err := clientset.CoreV1().ConfigMaps("velero").Get(context.Background(), "image-rewrite-result-test-restore", metav1.GetOptions{})
+		if err != nil {
+			t.Fatalf("Error getting result configmap: %v", err)
+		}
+
+		encoded, ok := resultConfigMap.Data["test-namespace_Deployment_test-deployment"]
+		if !ok {
+			t.Fatalf("result configmap missing expected key, got data = %v", resultConfigMap.Data)
+		}
+
+		var changes []ImageChange
+		if err := json.Unmarshal([]byte(encoded), &changes); err != nil {
+			t.Fatalf("Error unmarshaling recorded changes: %v", err)
+		}
+		if len(changes) != 1 {
+			t.Fatalf("got %d recorded changes, want 1", len(changes))
+		}
+
+		want := ImageChange{
+			Namespace: "test-namespace",
+			Kind:      "Deployment",
+			Name:      "test-deployment",
+			Container: "app",
+			OldImage:  "old-registry/app:v1.2.3",
+			NewImage:  "new-registry/app:v1.2.3",
+			Trigger:   "annotation",
+		}
+		if changes[0] != want {
+			t.Errorf("got recorded change = %+v, want %+v", changes[0], want)
+		}
+
+		// A second Progress call must not error or overwrite with an empty report.
+		if _, err := plugin.Progress(output.OperationID, restore); err != nil {
+			t.Errorf("Error calling Progress a second time: %v", err)
+		}
+	})
+
+	t.Run("Execute does not register an operation when nothing was rewritten", func(t *testing.T) {
+		deployment := appsv1.Deployment{
+			ObjectMeta: metav1.ObjectMeta{
+				Name:      "test-deployment",
+				Namespace: "test-namespace",
+			},
+			Spec: appsv1.DeploymentSpec{
+				Template: corev1.PodTemplateSpec{
+					Spec: corev1.PodSpec{
+						Containers: []corev1.Container{
+							{Name: "app", Image: "old-registry/app:v1.2.3"},
+						},
+					},
+				},
+			},
+		}
+
+		deploymentUnstructured, err := runtime.DefaultUnstructuredConverter.ToUnstructured(&deployment)
+		if err != nil {
+			t.Errorf("Error converting Deployment to unstructured: %v", err)
+		}
+		deploymentUnstructured["kind"] = "Deployment"
+
+		input := &velero.RestoreItemActionExecuteInput{
+			Item: &unstructured.Unstructured{
+				Object: deploymentUnstructured,
+			},
+			Restore: &velerov1.Restore{
+				ObjectMeta: metav1.ObjectMeta{
+					Name:      "test-restore",
+					Namespace: "velero",
+					UID:       types.UID("test-restore-uid-2"),
+				},
+			},
+		}
+
+		plugin := &RestorePluginV2{
+			log:      logrus.New(),
+			ruleSets: map[string]*RuleSet{},
+		}
+
+		output, err := plugin.Execute(input)
+		if err != nil {
+			t.Errorf("Error executing plugin: %v", err)
+		}
+		if output.OperationID != "" {
+			t.Errorf("Execute() OperationID = %q, want empty when no image was rewritten", output.OperationID)
+		}
+	})
 }
@@ -0,0 +1,81 @@
+package plugin
+
+import (
+	"context"
+	"strings"
+
+	"github.com/pkg/errors"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	"k8s.io/client-go/kubernetes"
+	"k8s.io/client-go/rest"
+)
+
+// rulesConfigMapKey is the data key within the rules ConfigMap holding the
+// rules.yaml document.
+const rulesConfigMapKey = "rules.yaml"
+
+// getRuleSet returns the RuleSet for the ConfigMap at ref ("namespace/name"),
+// loading and caching it on first use. The ConfigMap is assumed immutable for
+// the lifetime of the plugin process, matching how Velero treats its own
+// ResourceModifiers ConfigMap.
+func (p *RestorePluginV2) getRuleSet(ref string) (*RuleSet, error) {
+	p.ruleSetsMu.Lock()
+	defer p.ruleSetsMu.Unlock()
+
+	if rs, ok := p.ruleSets[ref]; ok {
+		return rs, nil
+	}
+
+	namespace, name, err := splitConfigMapRef(ref)
+	if err != nil {
+		return nil, err
+	}
+
+	client, err := p.getKubeClient()
+	if err != nil {
+		return nil, err
+	}
+
+	cm, err := client.CoreV1().ConfigMaps(namespace).Get(context.Background(), name, metav1.GetOptions{})
+	if err != nil {
+		return nil, errors.Wrapf(err, "failed to get image rewrite rules configmap %s", ref)
+	}
+
+	rs, err := ParseRuleSet([]byte(cm.Data[rulesConfigMapKey]))
+	if err != nil {
+		return nil, errors.Wrapf(err, "failed to parse image rewrite rules configmap %s", ref)
+	}
+
+	p.ruleSets[ref] = rs
+	return rs, nil
+}
+
+// getKubeClient lazily builds the in-cluster kubernetes client used to fetch
+// the rules ConfigMap. Tests inject a fake clientset via the kubeClient field
+// directly instead of going through this path.
+func (p *RestorePluginV2) getKubeClient() (kubernetes.Interface, error) {
+	if p.kubeClient != nil {
+		return p.kubeClient, nil
+	}
+
+	config, err := rest.InClusterConfig()
+	if err != nil {
+		return nil, errors.Wrap(err, "failed to load in-cluster kubernetes config")
+	}
+
+	client, err := kubernetes.NewForConfig(config)
+	if err != nil {
+		return nil, errors.Wrap(err, "failed to create kubernetes client")
+	}
+
+	p.kubeClient = client
+	return p.kubeClient, nil
+}
+
+func splitConfigMapRef(ref string) (namespace, name string, err error) {
+	parts := strings.SplitN(ref, "/", 2)
+	if len(parts) != 2 || parts[0] == "" || parts[1] == "" {
+		return "", "", errors.Errorf("%s must be in namespace/name form, got %q", imageRulesConfigMapAnnotation, ref)
+	}
+	return parts[0], parts[1], nil
+}
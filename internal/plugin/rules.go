@@ -0,0 +1,164 @@
+package plugin
+
+import (
+	"fmt"
+	"path"
+	"regexp"
+	"strings"
+
+	"github.com/pkg/errors"
+	"sigs.k8s.io/yaml"
+)
+
+// RuleMatch selects which containers a Rule applies to. Empty slices/strings
+// match everything for that dimension.
+type RuleMatch struct {
+	Namespaces         []string `json:"namespaces,omitempty"`
+	Kinds              []string `json:"kinds,omitempty"`
+	ContainerNameRegex string   `json:"containerNameRegex,omitempty"`
+	ImageRegex         string   `json:"imageRegex,omitempty"`
+}
+
+// RuleRewrite describes how to rewrite a matched image reference. Exactly one
+// of (FromRegistry, ToRegistry) or Replace is expected to be set; FromRegistry/
+// ToRegistry swaps the reference's registry domain, Replace is a
+// regexp.ReplaceAllString template evaluated against Match.ImageRegex.
+type RuleRewrite struct {
+	FromRegistry string `json:"fromRegistry,omitempty"`
+	ToRegistry   string `json:"toRegistry,omitempty"`
+	Replace      string `json:"replace,omitempty"`
+}
+
+// Rule is one entry of a RuleSet. Name is optional and purely cosmetic: when
+// set, it's used in place of the rule's index to identify which rule made a
+// change in the audit trail (see RuleSet.Rewrite).
+type Rule struct {
+	Name    string      `json:"name,omitempty"`
+	Match   RuleMatch   `json:"match,omitempty"`
+	Rewrite RuleRewrite `json:"rewrite"`
+
+	containerNameRegex *regexp.Regexp
+	imageRegex         *regexp.Regexp
+}
+
+// RuleSet is the parsed form of the `rules.yaml` key of an image rewrite rules
+// ConfigMap, modeled on Velero's ResourceModifiers.
+type RuleSet struct {
+	Rules []Rule `json:"rules"`
+
+	// ValidateImage and ValidateImagePolicy set the cluster-wide default for
+	// registry validation of rewritten images, used whenever an object doesn't
+	// carry its own eth-eks.velero/validate-image(-policy) annotation. See
+	// validationPolicy in imagevalidate.go.
+	ValidateImage       bool   `json:"validateImage,omitempty"`
+	ValidateImagePolicy string `json:"validateImagePolicy,omitempty"`
+}
+
+// ParseRuleSet parses and compiles a RuleSet from the YAML document found in a
+// rules.yaml ConfigMap key.
+func ParseRuleSet(data []byte) (*RuleSet, error) {
+	var rs RuleSet
+	if err := yaml.Unmarshal(data, &rs); err != nil {
+		return nil, errors.Wrap(err, "failed to parse image rewrite rules")
+	}
+	for i := range rs.Rules {
+		if err := rs.Rules[i].compile(); err != nil {
+			return nil, err
+		}
+	}
+	return &rs, nil
+}
+
+func (r *Rule) compile() error {
+	if r.Match.ContainerNameRegex != "" {
+		re, err := regexp.Compile(r.Match.ContainerNameRegex)
+		if err != nil {
+			return errors.Wrapf(err, "invalid containerNameRegex %q", r.Match.ContainerNameRegex)
+		}
+		r.containerNameRegex = re
+	}
+	if r.Match.ImageRegex != "" {
+		re, err := regexp.Compile(r.Match.ImageRegex)
+		if err != nil {
+			return errors.Wrapf(err, "invalid imageRegex %q", r.Match.ImageRegex)
+		}
+		r.imageRegex = re
+	}
+	return nil
+}
+
+// Rewrite walks the rules in order and applies the first one that both matches
+// (namespace, kind, containerName, image) and rewrites the image, returning the
+// rewritten image along with an identifier for that rule (its Name if set,
+// otherwise its index). A matching rule whose rewrite does not apply (e.g. its
+// fromRegistry differs from the image's registry) is skipped and the next rule
+// is tried. It returns changed=false, image unchanged, trigger="", if no rule
+// rewrote the image.
+func (rs *RuleSet) Rewrite(namespace, kind, containerName, image string) (newImage, trigger string, changed bool) {
+	for i, rule := range rs.Rules {
+		if !rule.matches(namespace, kind, containerName, image) {
+			continue
+		}
+		if rewritten, ok := rule.rewrite(image); ok {
+			return rewritten, rule.triggerName(i), true
+		}
+	}
+	return image, "", false
+}
+
+func (r Rule) triggerName(index int) string {
+	if r.Name != "" {
+		return r.Name
+	}
+	return fmt.Sprintf("rule[%d]", index)
+}
+
+func (r Rule) matches(namespace, kind, containerName, image string) bool {
+	if len(r.Match.Namespaces) > 0 && !matchesAnyGlob(r.Match.Namespaces, namespace) {
+		return false
+	}
+	if len(r.Match.Kinds) > 0 && !containsFold(r.Match.Kinds, kind) {
+		return false
+	}
+	if r.containerNameRegex != nil && !r.containerNameRegex.MatchString(containerName) {
+		return false
+	}
+	if r.imageRegex != nil && !r.imageRegex.MatchString(image) {
+		return false
+	}
+	return true
+}
+
+func (r Rule) rewrite(image string) (string, bool) {
+	switch {
+	case r.Rewrite.Replace != "" && r.imageRegex != nil:
+		return r.imageRegex.ReplaceAllString(image, r.Rewrite.Replace), true
+	case r.Rewrite.FromRegistry != "" && r.Rewrite.ToRegistry != "":
+		ref := ParseImageReference(image)
+		if ref.Domain != r.Rewrite.FromRegistry {
+			return image, false
+		}
+		ref.Domain = r.Rewrite.ToRegistry
+		return ref.String(), true
+	default:
+		return image, false
+	}
+}
+
+func matchesAnyGlob(patterns []string, value string) bool {
+	for _, pattern := range patterns {
+		if ok, _ := path.Match(pattern, value); ok {
+			return true
+		}
+	}
+	return false
+}
+
+func containsFold(values []string, value string) bool {
+	for _, v := range values {
+		if strings.EqualFold(v, value) {
+			return true
+		}
+	}
+	return false
+}
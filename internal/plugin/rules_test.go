@@ -0,0 +1,112 @@
+package plugin
+
+import "testing"
+
+func TestRuleSet_Rewrite(t *testing.T) {
+	t.Run("wildcard namespace and kind match", func(t *testing.T) {
+		rs, err := ParseRuleSet([]byte(`
+rules:
+  - match: {namespaces: ["prod-*"], kinds: ["Deployment", "StatefulSet"]}
+    rewrite: {fromRegistry: "old-registry.io", toRegistry: "new-registry.internal"}
+`))
+		if err != nil {
+			t.Fatalf("ParseRuleSet() error = %v", err)
+		}
+
+		got, trigger, changed := rs.Rewrite("prod-payments", "Deployment", "app", "old-registry.io/app:v1")
+		if !changed {
+			t.Fatalf("Rewrite() changed = false, want true")
+		}
+		if want := "new-registry.internal/app:v1"; got != want {
+			t.Errorf("Rewrite() = %q, want %q", got, want)
+		}
+		if want := "rule[0]"; trigger != want {
+			t.Errorf("Rewrite() trigger = %q, want %q", trigger, want)
+		}
+
+		if _, _, changed := rs.Rewrite("staging", "Deployment", "app", "old-registry.io/app:v1"); changed {
+			t.Errorf("Rewrite() matched non-wildcarded namespace, want no match")
+		}
+
+		if _, _, changed := rs.Rewrite("prod-payments", "Job", "app", "old-registry.io/app:v1"); changed {
+			t.Errorf("Rewrite() matched kind not in rule, want no match")
+		}
+	})
+
+	t.Run("regex capture substitution", func(t *testing.T) {
+		rs, err := ParseRuleSet([]byte(`
+rules:
+  - name: mirror-dockerhub-library
+    match: {imageRegex: "^docker.io/library/(.*)$"}
+    rewrite: {replace: "mirror.internal/library/$1"}
+`))
+		if err != nil {
+			t.Fatalf("ParseRuleSet() error = %v", err)
+		}
+
+		got, trigger, changed := rs.Rewrite("any-namespace", "Pod", "app", "docker.io/library/nginx:1.25")
+		if !changed {
+			t.Fatalf("Rewrite() changed = false, want true")
+		}
+		if want := "mirror.internal/library/nginx:1.25"; got != want {
+			t.Errorf("Rewrite() = %q, want %q", got, want)
+		}
+		if want := "mirror-dockerhub-library"; trigger != want {
+			t.Errorf("Rewrite() trigger = %q, want %q (named rule)", trigger, want)
+		}
+	})
+
+	t.Run("first matching rule wins", func(t *testing.T) {
+		rs, err := ParseRuleSet([]byte(`
+rules:
+  - match: {containerNameRegex: "^app$"}
+    rewrite: {fromRegistry: "old-registry.io", toRegistry: "specific-override.internal"}
+  - match: {}
+    rewrite: {fromRegistry: "old-registry.io", toRegistry: "catch-all.internal"}
+`))
+		if err != nil {
+			t.Fatalf("ParseRuleSet() error = %v", err)
+		}
+
+		got, _, changed := rs.Rewrite("ns", "Deployment", "app", "old-registry.io/app:v1")
+		if !changed {
+			t.Fatalf("Rewrite() changed = false, want true")
+		}
+		if want := "specific-override.internal/app:v1"; got != want {
+			t.Errorf("Rewrite() = %q, want %q (first matching rule should win)", got, want)
+		}
+
+		got, trigger, changed := rs.Rewrite("ns", "Deployment", "sidecar", "old-registry.io/sidecar:v1")
+		if !changed {
+			t.Fatalf("Rewrite() changed = false, want true")
+		}
+		if want := "catch-all.internal/sidecar:v1"; got != want {
+			t.Errorf("Rewrite() = %q, want %q (should fall through to catch-all rule)", got, want)
+		}
+		if want := "rule[1]"; trigger != want {
+			t.Errorf("Rewrite() trigger = %q, want %q", trigger, want)
+		}
+	})
+
+	t.Run("no rule matches leaves image unchanged", func(t *testing.T) {
+		rs, err := ParseRuleSet([]byte(`
+rules:
+  - match: {namespaces: ["prod-*"]}
+    rewrite: {fromRegistry: "old-registry.io", toRegistry: "new-registry.internal"}
+`))
+		if err != nil {
+			t.Fatalf("ParseRuleSet() error = %v", err)
+		}
+
+		got, trigger, changed := rs.Rewrite("dev", "Deployment", "app", "old-registry.io/app:v1")
+		if changed {
+			t.Errorf("Rewrite() changed = true, want false")
+		}
+		if want := "old-registry.io/app:v1"; got != want {
+			t.Errorf("Rewrite() = %q, want unchanged %q", got, want)
+		}
+		if trigger != "" {
+			t.Errorf("Rewrite() trigger = %q, want empty when unchanged", trigger)
+		}
+	})
+}